@@ -11,31 +11,313 @@
 package sql_test
 
 import (
+	"bytes"
 	"context"
 	gosql "database/sql"
 	"fmt"
+	"regexp"
 	"strings"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
-	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/datadriven"
+	"github.com/lib/pq"
 )
 
+// isWriteStmt reports whether body is a statement that writes to the test
+// table t, for deciding whether a step should be recorded on the progress
+// bar. It's deliberately narrow (vs. "any INSERT/UPDATE/.../DELETE") because
+// beforeExecute/AfterExecute fire for every statement the server runs,
+// including background internal ones (lease acquisition upserts, jobs,
+// stats) that happen to share a DML keyword but never touch t.
+var writeStmtRE = regexp.MustCompile(`(?i)^(INSERT|UPSERT)\s+INTO\s+t\b|^UPDATE\s+t\b|^DELETE\s+FROM\s+t\b`)
+
+func isWriteStmt(body string) bool {
+	return writeStmtRE.MatchString(strings.TrimSpace(body))
+}
+
+// savepointName returns the target of a `SAVEPOINT <name>` statement.
+func savepointName(body string) (name string, ok bool) {
+	const prefix = "SAVEPOINT "
+	upper := strings.ToUpper(strings.TrimSpace(body))
+	if !strings.HasPrefix(upper, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(body[len(prefix):]), true
+}
+
+// rollbackToSavepointName returns the target of a
+// `ROLLBACK TO SAVEPOINT <name>` statement.
+func rollbackToSavepointName(body string) (name string, ok bool) {
+	const prefix = "ROLLBACK TO SAVEPOINT "
+	upper := strings.ToUpper(strings.TrimSpace(body))
+	if !strings.HasPrefix(upper, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(body[len(prefix):]), true
+}
+
+// isPlainRollback reports whether body unwinds the whole transaction (as
+// opposed to rolling back to a savepoint).
+func isPlainRollback(body string) bool {
+	upper := strings.ToUpper(strings.TrimSpace(body))
+	return upper == "ROLLBACK" || upper == "ABORT"
+}
+
+// sequencer replaces the old flaky harness, which raced a background
+// connection issuing writes against a separate "progress" connection
+// polling for them. It hooks sql.ExecutorTestingKnobs.BeforeExecute and
+// AfterExecute to (a) gate a connection's statements behind an explicit
+// "advance" signal driven by the "wait"/"signal" datadriven directives, and
+// (b) record write progress, savepoint state and cockroach_restart rewinds
+// in memory as they happen, so updateProgress reads a snapshot taken under
+// the same knob rather than racing a second SQL connection against async
+// schema/txn state. The transaction status is not part of that snapshot:
+// getTxnStatus still runs SHOW TRANSACTION STATUS on the statement's own
+// connection.
+//
+// BeforeExecute/AfterExecute are handed sql.Statement.String(), i.e. the
+// parsed AST rendered back out with FmtHideConstants -- any comment on the
+// original statement text is gone by the time these callbacks see it, so
+// identity can't be smuggled through the SQL text. Instead, since the "sql"
+// directive drives exactly one connection through the foreground call stack
+// at a time (there is never a second goroutine issuing statements on
+// another connection while one is in flight), the driving loop itself
+// records which connection/step is about to run in s.mu.activeConn and
+// s.mu.activeStep right before
+// each statement, and these callbacks just read that back.
+type sequencer struct {
+	mu struct {
+		syncutil.Mutex
+		// gates, when present for a connection, blocks that connection's
+		// next statement in beforeExecute until release() closes it.
+		gates map[string]chan struct{}
+		// progress records, per connection, the 1-based statement indexes
+		// whose write has been observed by afterExecute.
+		progress map[string][]int
+		// savepoints records, per connection and savepoint name, the
+		// progress snapshot captured when that savepoint was created, so a
+		// later ROLLBACK TO SAVEPOINT can restore it.
+		savepoints map[string]map[string][]int
+		// restarts counts, per connection, successful
+		// `ROLLBACK TO SAVEPOINT cockroach_restart` statements -- observed
+		// directly from the statement text, not guessed from error prose.
+		restarts map[string]int
+		// activeConn and activeStep identify the connection and step
+		// currently being driven through sqlConn.ExecContext by the "sql"
+		// directive, for beforeExecute/afterExecute to attribute to.
+		activeConn string
+		activeStep int
+		// tablePrefix is table t's KV key prefix, resolved the first time
+		// "force-retry" is armed (by then the fixture has already created
+		// t). It scopes injected retries to t's keyspan so background
+		// sqlliveness/jobs/stats writes sharing the same store never
+		// consume an armed injection meant for the test's own write.
+		tablePrefix roachpb.Key
+		// forceRetry, when positive, arms that many injected serialization
+		// failures on the next write(s) to table t from any connection. It
+		// isn't scoped to a single connection: the harness only ever has
+		// one connection actively writing at a time, so a single counter
+		// is sufficient.
+		forceRetry int
+		// injectedRetries counts how many times requestFilter has actually
+		// returned an injected retry error.
+		injectedRetries int
+	}
+}
+
+func newSequencer() *sequencer {
+	s := &sequencer{}
+	s.mu.gates = make(map[string]chan struct{})
+	s.mu.progress = make(map[string][]int)
+	s.mu.savepoints = make(map[string]map[string][]int)
+	s.mu.restarts = make(map[string]int)
+	return s
+}
+
+// hold installs a gate for connName: the connection's next statement blocks
+// in beforeExecute until release(connName) is called.
+func (s *sequencer) hold(connName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.gates[connName] = make(chan struct{})
+}
+
+// release lets a connection previously paused by hold proceed.
+func (s *sequencer) release(connName string) {
+	s.mu.Lock()
+	gate := s.mu.gates[connName]
+	delete(s.mu.gates, connName)
+	s.mu.Unlock()
+	if gate != nil {
+		close(gate)
+	}
+}
+
+// armForceRetry arms count injected serialization failures on table t's
+// next write(s), for the "force-retry" datadriven directive.
+// The table ID is looked up before s.mu is taken: the lookup is itself a SQL
+// statement, and its BeforeExecute/AfterExecute callbacks take s.mu.
+func (s *sequencer) armForceRetry(t *testing.T, db *gosql.DB, count int) {
+	tableID := sqlutils.QueryTableID(t, db, "defaultdb", "t")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.tablePrefix == nil {
+		s.mu.tablePrefix = keys.SystemSQLCodec.TablePrefix(uint32(tableID))
+	}
+	s.mu.forceRetry += count
+}
+
+// requestFilter is wired as a kvserver.StoreTestingKnobs.TestingRequestFilter.
+// It injects a TransactionRetryError into the next count writes that land
+// on table t's key span, emulating the serialization failures that a
+// `SAVEPOINT cockroach_restart` is meant to transparently retry past.
+func (s *sequencer) requestFilter(ctx context.Context, ba *roachpb.BatchRequest) *roachpb.Error {
+	if ba.IsReadOnly() {
+		return nil
+	}
+	s.mu.Lock()
+	armed := false
+	if prefix := s.mu.tablePrefix; prefix != nil {
+		for _, ru := range ba.Requests {
+			if bytes.HasPrefix(ru.GetInner().Header().Key, prefix) {
+				armed = s.mu.forceRetry > 0
+				break
+			}
+		}
+	}
+	if armed {
+		s.mu.forceRetry--
+		s.mu.injectedRetries++
+	}
+	s.mu.Unlock()
+	if !armed {
+		return nil
+	}
+	return roachpb.NewError(roachpb.NewTransactionRetryError(
+		roachpb.RETRY_SERIALIZABLE, "injected by force-retry datadriven directive",
+	))
+}
+
+// setActive records which connection/step is about to be driven through
+// sqlConn.ExecContext, for beforeExecute/afterExecute to read.
+func (s *sequencer) setActive(connName string, step int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.activeConn, s.mu.activeStep = connName, step
+}
+
+func (s *sequencer) clearActive() {
+	s.setActive("", 0)
+}
+
+func (s *sequencer) beforeExecute(ctx context.Context, stmt string) {
+	s.mu.Lock()
+	connName := s.mu.activeConn
+	gate := s.mu.gates[connName]
+	s.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+}
+
+func (s *sequencer) afterExecute(ctx context.Context, stmt string, err error) {
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	connName, step := s.mu.activeConn, s.mu.activeStep
+	s.mu.Unlock()
+	if connName == "" {
+		return
+	}
+	body := strings.TrimSpace(stmt)
+
+	if name, ok := rollbackToSavepointName(body); ok {
+		s.mu.Lock()
+		if snap, ok := s.mu.savepoints[connName][name]; ok {
+			s.mu.progress[connName] = append([]int(nil), snap...)
+		}
+		if strings.EqualFold(name, "cockroach_restart") {
+			s.mu.restarts[connName]++
+		}
+		s.mu.Unlock()
+		return
+	}
+	if isPlainRollback(body) {
+		s.mu.Lock()
+		delete(s.mu.progress, connName)
+		delete(s.mu.savepoints, connName)
+		s.mu.Unlock()
+		return
+	}
+	if name, ok := savepointName(body); ok {
+		s.mu.Lock()
+		if s.mu.savepoints[connName] == nil {
+			s.mu.savepoints[connName] = make(map[string][]int)
+		}
+		s.mu.savepoints[connName][name] = append([]int(nil), s.mu.progress[connName]...)
+		s.mu.Unlock()
+		return
+	}
+	if isWriteStmt(body) {
+		s.mu.Lock()
+		s.mu.progress[connName] = append(s.mu.progress[connName], step)
+		s.mu.Unlock()
+	}
+}
+
+// injectedRetryCount returns how many force-retry errors requestFilter has
+// injected so far. It counts injections at the KV layer; whether each one
+// reached the client as an error is not tracked.
+func (s *sequencer) injectedRetryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.injectedRetries
+}
+
+// snapshot returns connName's recorded progress and cockroach_restart count.
+func (s *sequencer) snapshot(connName string) (progress []int, restarts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.mu.progress[connName]...), s.mu.restarts[connName]
+}
+
+func (s *sequencer) resetConn(connName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mu.progress, connName)
+	delete(s.mu.savepoints, connName)
+	delete(s.mu.restarts, connName)
+}
+
 func TestSavepoints(t *testing.T) {
 	defer leaktest.AfterTest(t)()
-	skip.WithIssue(t, 70220, "flaky test")
 	defer log.Scope(t).Close(t)
 
 	ctx := context.Background()
 	datadriven.Walk(t, "testdata/savepoints", func(t *testing.T, path string) {
+		seq := newSequencer()
 
 		params := base.TestServerArgs{}
+		params.Knobs.SQLExecutor = &sql.ExecutorTestingKnobs{
+			BeforeExecute: seq.beforeExecute,
+			AfterExecute:  seq.afterExecute,
+		}
+		params.Knobs.Store = &kvserver.StoreTestingKnobs{
+			TestingRequestFilter: seq.requestFilter,
+		}
 		s, db, _ := serverutils.StartServer(t, params)
 		defer s.Stopper().Stop(ctx)
 
@@ -53,19 +335,62 @@ func TestSavepoints(t *testing.T) {
 			return conn
 		}
 
-		// progressConn is used to manipulate the progress table.
-		progressConn := getConn("progress")
-		if _, err := progressConn.ExecContext(ctx, `CREATE TABLE progress(
-      conn STRING,
-    	n INT, 
-    	marker BOOL,
-    	PRIMARY KEY (conn, n)
-	  )`); err != nil {
-			t.Fatal(err)
-		}
-
 		datadriven.RunTest(t, path, func(t *testing.T, td *datadriven.TestData) string {
 			switch td.Cmd {
+			case "wait":
+				// "wait conn=B" pauses conn B before its next statement,
+				// letting the script drive other connections first without
+				// B racing ahead.
+				connName := "default"
+				td.ScanArgs(t, "conn", &connName)
+				seq.hold(connName)
+				return ""
+
+			case "signal":
+				// "signal conn=B" releases a connection previously paused by
+				// "wait", letting its next statement proceed.
+				connName := "default"
+				td.ScanArgs(t, "conn", &connName)
+				seq.release(connName)
+				return ""
+
+			case "force-retry":
+				// "force-retry [count=N]" arms N (default 1) injected 40001
+				// serialization failures on table t's next write(s), to
+				// exercise the `SAVEPOINT cockroach_restart` retry protocol
+				// without depending on real contention.
+				count := 1
+				if td.HasArg("count") {
+					td.ScanArgs(t, "count", &count)
+				}
+				seq.armForceRetry(t, db, count)
+				return ""
+
+			case "expect-retry":
+				// "expect-retry [count=N]" asserts that requestFilter has
+				// injected at least N (default 1) force-retry errors since
+				// this test file started.
+				count := 1
+				if td.HasArg("count") {
+					td.ScanArgs(t, "count", &count)
+				}
+				injected := seq.injectedRetryCount()
+				if injected < count {
+					td.Fatalf(t, "expected at least %d injected retries, got %d", count, injected)
+				}
+				return fmt.Sprintf("retries: %d\n", injected)
+
+			case "expect-restart":
+				connName := "default"
+				if td.HasArg("conn") {
+					td.ScanArgs(t, "conn", &connName)
+				}
+				_, restarts := seq.snapshot(connName)
+				if restarts == 0 {
+					td.Fatalf(t, "expected at least one cockroach_restart rewind on %q, got none", connName)
+				}
+				return fmt.Sprintf("restarts: %d\n", restarts)
+
 			case "sql":
 				// Determine which connection to run the SQL statements on. If no
 				// connection specifier is provided, use the "default" conn.
@@ -76,11 +401,10 @@ func TestSavepoints(t *testing.T) {
 				sqlConn := getConn(connName)
 
 				// Implicitly abort any previously-ongoing txn.
+				seq.clearActive()
 				_, _ = sqlConn.ExecContext(ctx, "ABORT")
-				// Prepare for the next test.
-				if _, err := progressConn.ExecContext(ctx, "DELETE FROM progress WHERE conn = $1", connName); err != nil {
-					td.Fatalf(t, "cleaning up: %v", err)
-				}
+				// Start this block's progress snapshot from scratch.
+				seq.resetConn(connName)
 
 				// Prepare a buffer to accumulate the results.
 				var buf strings.Builder
@@ -105,23 +429,14 @@ func TestSavepoints(t *testing.T) {
 				// in the input.
 				var stepNum int
 
-				// updateProgress loads the current set of writes
-				// into the progress bar.
+				// updateProgress loads the current set of writes from the
+				// in-memory snapshot captured by afterExecute into the
+				// progress bar.
 				updateProgress := func() {
-					rows, err := progressConn.QueryContext(ctx, "SELECT n FROM progress WHERE conn = $1", connName)
-					if err != nil {
-						t.Logf("%d: reading progress: %v", stepNum, err)
-						// It's OK if we can't read this.
-						return
-					}
-					defer rows.Close()
-					for rows.Next() {
-						var n int
-						if err := rows.Scan(&n); err != nil {
-							td.Fatalf(t, "%d: unexpected error while reading progress: %v", stepNum, err)
-						}
+					marked, _ := seq.snapshot(connName)
+					for _, n := range marked {
 						if n < 1 || n > len(progressBar) {
-							td.Fatalf(t, "%d: unexpected stepnum in progress table: %d", stepNum, n)
+							td.Fatalf(t, "%d: unexpected stepnum in progress snapshot: %d", stepNum, n)
 						}
 						progressBar[n-1] = '#'
 					}
@@ -185,20 +500,13 @@ func TestSavepoints(t *testing.T) {
 				beforeStatus := getTxnStatus()
 				for i, stmt := range stmts {
 					stepNum = i + 1
-					// Before each statement, mark the progress so far with
-					// a KV write.
-					if isOpenTxn(beforeStatus) {
-						_, err := progressConn.ExecContext(ctx, "INSERT INTO progress(conn, n, marker) VALUES ($1, $2, true)", connName, stepNum)
-						if err != nil {
-							td.Fatalf(t, "%d: before-stmt: %v", stepNum, err)
-						}
-					}
+					seq.setActive(connName, stepNum)
 
 					// Run the statement and report errors/results.
 					fmt.Fprintf(&buf, "%d: %s -- ", stepNum, stmt)
 					execRes, err := sqlConn.ExecContext(ctx, stmt)
 					if err != nil {
-						fmt.Fprintf(&buf, "%v\n", err)
+						fmt.Fprintf(&buf, "%s\n", describeExecErr(err))
 					} else {
 						nRows, err := execRes.RowsAffected()
 						if err != nil {
@@ -224,6 +532,19 @@ func TestSavepoints(t *testing.T) {
 	})
 }
 
+// describeExecErr renders an exec error for the fixture output. Serialization
+// failures are reported by SQLSTATE rather than the full wrapped message:
+// the prose cockroach attaches to a 40001 (which internal retry layer
+// produced it, how it got wrapped on its way back to the client) is liable
+// to change across releases, while the code is the stable, documented
+// contract a client actually relies on.
+func describeExecErr(err error) string {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pq.ErrorCode(pgcode.SerializationFailure.String()) {
+		return fmt.Sprintf("serialization failure (%s)", pqErr.Code)
+	}
+	return err.Error()
+}
+
 func isOpenTxn(status string) bool {
 	return status == sql.OpenStateStr || status == sql.NoTxnStateStr
 }
@@ -30,6 +30,16 @@ func init() {
 				}),
 			),
 		),
+		// Deferred: routing RENAME COLUMN through op-generation (as a paired
+		// add/drop keyed by (TableID, ColumnID) with the new name guaranteed
+		// to be emitted before the old one is removed) needs scbuild to emit
+		// the old and new ColumnName elements as a dependent pair plus
+		// scplan/rules dep rules ordering them -- opgen transitions are
+		// per-element and can't express that cross-element ordering on their
+		// own, and neither scbuild nor scplan/rules is touched here. Until
+		// that builder/dep-rule support lands, RENAME COLUMN stays on the
+		// legacy schema changer and this registration continues to model
+		// only a standalone add/drop, identical to before this change.
 		drop(
 			to(scpb.Status_ABSENT,
 				minPhase(scop.PostCommitPhase),